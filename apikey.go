@@ -0,0 +1,114 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	anthropic "github.com/liushuangls/go-anthropic/v2"
+)
+
+// the Anthropic client, replaced when the API key is reloaded on SIGHUP, and the clients
+// for the keys of ChannelKeys, dropped when those are reloaded
+var anthropicClient = struct {
+	sync.RWMutex
+	client      *anthropic.Client
+	options     []anthropic.ClientOption
+	channelKeys map[string]string
+	byKey       map[string]*anthropic.Client
+}{byKey: make(map[string]*anthropic.Client)}
+
+// clientFor returns the client for the channel's own API key if it has one, the current client otherwise
+func clientFor(config Config, channel string) *anthropic.Client {
+	anthropicClient.RLock()
+	key := ""
+	name := channelName(config, channel)
+	for configured, channelKey := range anthropicClient.channelKeys {
+		if normalizeChannel(configured) == name {
+			key = channelKey
+		}
+	}
+	client, ok := anthropicClient.client, true
+	if key != "" {
+		client, ok = anthropicClient.byKey[key]
+	}
+	anthropicClient.RUnlock()
+	if ok {
+		return client
+	}
+
+	// first request with this key, build its client unless another request just did
+	anthropicClient.Lock()
+	defer anthropicClient.Unlock()
+	client, ok = anthropicClient.byKey[key]
+	if !ok {
+		client = anthropic.NewClient(key, anthropicClient.options...)
+		anthropicClient.byKey[key] = client
+	}
+	return client
+}
+
+// setAPIKey rebuilds the Anthropic client with the given key, keeping the client options
+func setAPIKey(key string, options ...anthropic.ClientOption) {
+	anthropicClient.Lock()
+	defer anthropicClient.Unlock()
+	if options != nil {
+		anthropicClient.options = options
+	}
+	anthropicClient.client = anthropic.NewClient(key, anthropicClient.options...)
+}
+
+// setChannelKeys replaces the per-channel API keys and drops the clients built for the old ones
+func setChannelKeys(keys map[string]string) {
+	anthropicClient.Lock()
+	defer anthropicClient.Unlock()
+	anthropicClient.channelKeys = keys
+	anthropicClient.byKey = make(map[string]*anthropic.Client)
+}
+
+// apiKey returns the Anthropic API key: read from AnthropicKeyFile if set, else the
+// anthropic_api_key setting, else the ANTHROPIC_API_KEY environment variable
+func apiKey(config Config) string {
+	if config.AnthropicKeyFile != "" {
+		key, err := os.ReadFile(config.AnthropicKeyFile)
+		if err != nil {
+			log.Printf("Error reading API key file: %v\n", err)
+			return ""
+		}
+		return strings.TrimSpace(string(key))
+	}
+	if config.AnthropicKey != "" {
+		return config.AnthropicKey
+	}
+	return os.Getenv("ANTHROPIC_API_KEY")
+}
+
+// reloadOnHangup re-reads the configuration on SIGHUP and applies the system prompts and the
+// API keys, so a rotated key or an edited prompt is picked up without reconnecting. Other
+// settings only change with a restart.
+func reloadOnHangup(configFile *string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			config, failed := readConfig(configFile)
+			if failed {
+				log.Printf("Keeping the current system prompt and API keys\n")
+				continue
+			}
+			setSystemPrompts(config)
+			setChannelKeys(config.ChannelKeys)
+			log.Printf("Reloaded the system prompt and per-channel API keys, other settings need a restart\n")
+			key := apiKey(config)
+			if key == "" {
+				log.Printf("No API key found, keeping the current one\n")
+				continue
+			}
+			setAPIKey(key)
+			log.Printf("Reloaded the Anthropic API key\n")
+		}
+	}()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultAuditMaxBytes = 10 * 1024 * 1024
+const auditQueueSize = 100
+
+var auditLog *AuditLogger
+
+// AuditEntry is one line in the audit file
+type AuditEntry struct {
+	Time         time.Time `json:"time"`
+	Channel      string    `json:"channel"`
+	Nick         string    `json:"nick"`
+	Prompt       string    `json:"prompt"`
+	Response     string    `json:"response"`
+	Error        string    `json:"error,omitempty"`
+	InputTokens  int       `json:"input_tokens"`
+	OutputTokens int       `json:"output_tokens"`
+}
+
+// AuditLogger appends JSON lines to a file from a single goroutine and rotates it by size
+type AuditLogger struct {
+	path     string
+	maxBytes int64
+	entries  chan AuditEntry
+	done     chan struct{}
+	file     *os.File
+	size     int64
+
+	mu     sync.Mutex // guards closed against Log racing with Close
+	closed bool
+}
+
+func NewAuditLogger(path string, maxBytes int64) (*AuditLogger, error) {
+	if maxBytes <= 0 {
+		maxBytes = defaultAuditMaxBytes
+	}
+	a := &AuditLogger{
+		path:     path,
+		maxBytes: maxBytes,
+		entries:  make(chan AuditEntry, auditQueueSize),
+		done:     make(chan struct{}),
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	go a.run()
+	return a, nil
+}
+
+// Log queues an entry for writing; if the queue is full the entry is dropped so message handling never stalls
+func (a *AuditLogger) Log(entry AuditEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return
+	}
+	select {
+	case a.entries <- entry:
+	default:
+		log.Printf("Audit queue full, dropping entry for %s\n", entry.Channel)
+	}
+}
+
+// Close writes the queued entries and closes the file; later entries are discarded
+func (a *AuditLogger) Close() {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.entries)
+	}
+	a.mu.Unlock()
+	<-a.done
+}
+
+func (a *AuditLogger) run() {
+	defer close(a.done)
+	for entry := range a.entries {
+		if err := a.write(entry); err != nil {
+			log.Printf("Error writing audit entry: %v\n", err)
+		}
+	}
+	if err := a.file.Close(); err != nil {
+		log.Printf("Failed to close audit file: %v", err)
+	}
+}
+
+func (a *AuditLogger) write(entry AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if a.size+int64(len(line)) > a.maxBytes && a.size > 0 {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+// rotate moves the current file to <path>.1, replacing any previous rotation, and starts a new file
+func (a *AuditLogger) rotate() error {
+	if err := a.file.Close(); err != nil {
+		log.Printf("Failed to close audit file: %v", err)
+	}
+	if err := os.Rename(a.path, a.path+".1"); err != nil {
+		// keep appending to the current file rather than losing all later entries
+		if openErr := a.open(); openErr != nil {
+			log.Printf("Failed to reopen audit file: %v\n", openErr)
+		}
+		return fmt.Errorf("rotating audit file: %w", err)
+	}
+	return a.open()
+}
+
+func (a *AuditLogger) open() error {
+	file, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const budgetWindow = 24 * time.Hour
+
+// channelBudget counts tokens used in a channel since the start of the current window
+type channelBudget struct {
+	windowStart time.Time
+	tokens      int
+}
+
+// token usage per channel; kept in memory only, as there is no persistence for the context yet
+var tokenBudgets = struct {
+	sync.Mutex
+	channels map[string]*channelBudget
+}{channels: make(map[string]*channelBudget)}
+
+// budgetFor returns the channel's budget, starting a new window when the previous one has ended.
+// The caller must hold the tokenBudgets lock.
+func budgetFor(channel string, now time.Time) *channelBudget {
+	budget, ok := tokenBudgets.channels[channel]
+	if !ok || now.Sub(budget.windowStart) >= budgetWindow {
+		budget = &channelBudget{windowStart: now}
+		tokenBudgets.channels[channel] = budget
+	}
+	return budget
+}
+
+// budgetExceeded reports whether the channel has used up its daily token budget; a limit of 0 means unlimited
+func budgetExceeded(channel string, limit int) bool {
+	if limit <= 0 {
+		return false
+	}
+	tokenBudgets.Lock()
+	defer tokenBudgets.Unlock()
+	return budgetFor(channel, time.Now()).tokens >= limit
+}
+
+// addTokenUsage adds the tokens of a request to the channel's budget
+func addTokenUsage(channel string, tokens int) {
+	tokenBudgets.Lock()
+	defer tokenBudgets.Unlock()
+	budgetFor(channel, time.Now()).tokens += tokens
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+const promptCachingBeta = "prompt-caching-2024-07-31"
+
+// cachingTransport marks the system prompt as cacheable. The SDK version we use has no
+// cache_control fields, so the request body is rewritten on its way out.
+type cachingTransport struct {
+	base     http.RoundTripper
+	disabled atomic.Bool
+}
+
+func newCachingTransport() *cachingTransport {
+	return &cachingTransport{base: http.DefaultTransport}
+}
+
+func (t *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.disabled.Load() || req.Body == nil {
+		return t.base.RoundTrip(req)
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	_ = req.Body.Close()
+
+	cached, ok := withCachedSystemPrompt(body)
+	if !ok {
+		return t.base.RoundTrip(withBody(req, body))
+	}
+
+	cachedReq := withBody(req, cached)
+	beta := promptCachingBeta
+	if existing := req.Header.Get("anthropic-beta"); existing != "" {
+		beta = existing + "," + beta
+	}
+	cachedReq.Header.Set("anthropic-beta", beta)
+
+	resp, err := t.base.RoundTrip(cachedReq)
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		return resp, err
+	}
+
+	errBody, readErr := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(errBody))
+	if readErr != nil || !rejectsCaching(errBody) {
+		return resp, nil
+	}
+
+	// the API or model rejected the cache fields, stop using them and send the original request
+	log.Printf("Prompt caching rejected by the API, disabling it\n")
+	t.disabled.Store(true)
+	return t.base.RoundTrip(withBody(req, body))
+}
+
+// rejectsCaching tells whether a 400 response is about the cache fields rather than the request itself
+func rejectsCaching(body []byte) bool {
+	return bytes.Contains(body, []byte("cache_control")) ||
+		bytes.Contains(body, []byte("anthropic-beta")) ||
+		bytes.Contains(body, []byte(promptCachingBeta))
+}
+
+// withCachedSystemPrompt turns a plain "system" string into a text block with cache_control
+func withCachedSystemPrompt(body []byte) ([]byte, bool) {
+	var request map[string]json.RawMessage
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, false
+	}
+	var system string
+	if raw, ok := request["system"]; !ok || json.Unmarshal(raw, &system) != nil || system == "" {
+		return nil, false
+	}
+	blocks, err := json.Marshal([]map[string]any{{
+		"type":          "text",
+		"text":          system,
+		"cache_control": map[string]string{"type": "ephemeral"},
+	}})
+	if err != nil {
+		return nil, false
+	}
+	request["system"] = blocks
+	rewritten, err := json.Marshal(request)
+	if err != nil {
+		return nil, false
+	}
+	return rewritten, true
+}
+
+// withBody returns a copy of the request with the given body
+func withBody(req *http.Request, body []byte) *http.Request {
+	clone := req.Clone(req.Context())
+	clone.Body = io.NopCloser(bytes.NewReader(body))
+	clone.ContentLength = int64(len(body))
+	clone.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return clone
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// random source for ReplyProbability, seeded from ReplyProbabilitySeed for reproducible tests
+var chimeRandom = struct {
+	sync.Mutex
+	rng *rand.Rand
+}{rng: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// initChimeRandom reseeds the random source if a seed is configured
+func initChimeRandom(config Config) {
+	if config.ReplyProbabilitySeed != nil {
+		chimeRandom.Lock()
+		chimeRandom.rng = rand.New(rand.NewSource(*config.ReplyProbabilitySeed))
+		chimeRandom.Unlock()
+	}
+}
+
+// shouldChimeIn decides whether to answer a message that doesn't address the bot:
+// it has to look like a question and win a roll against ReplyProbability
+func shouldChimeIn(config Config, text string) bool {
+	if config.ReplyProbability <= 0 || !looksLikeQuestion(text) {
+		return false
+	}
+	chimeRandom.Lock()
+	defer chimeRandom.Unlock()
+	return chimeRandom.rng.Float64() < config.ReplyProbability
+}
+
+// looksLikeQuestion reports whether the text ends with a question mark and has a few words
+func looksLikeQuestion(text string) bool {
+	text = strings.TrimSpace(text)
+	return strings.HasSuffix(text, "?") && len(strings.Fields(text)) >= 3
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+const commandPrefix = "!"
+
+// prompt sent for !continue
+const continuePrompt = "Please continue your previous answer exactly where it was cut off."
+
+// command is a bot command like !reset; admin commands are restricted by isAdmin, owner commands by isOwner
+type command struct {
+	admin bool
+	owner bool
+	run   func(config Config, conn *irc.Conn, line *irc.Line, args []string)
+}
+
+var commands = map[string]command{
+	"reset":      {admin: true, run: cmdReset},
+	"context":    {run: cmdContext},
+	"model":      {admin: true, run: cmdModel},
+	"export":     {admin: true, run: cmdExport},
+	"shutdown":   {owner: true, run: cmdShutdown},
+	"forgetme":   {run: cmdForgetMe},
+	"rememberme": {run: cmdRememberMe},
+	"forget":     {run: cmdForget},
+	"regenerate": {run: cmdRegenerate},
+	"retry":      {run: cmdRegenerate},
+	"continue":   {run: cmdContinue},
+	"length":     {admin: true, run: cmdLength},
+	"config":     {owner: true, run: cmdConfig},
+}
+
+// config settings that are never shown by !config
+var secretSettings = map[string]bool{
+	"anthropic_api_key": true,
+	"irc_password":      true,
+	"openai_api_key":    true,
+}
+
+// handleCommand runs the command in the line, if any, and reports whether the line was a command
+func handleCommand(config Config, conn *irc.Conn, line *irc.Line) bool {
+	if !strings.HasPrefix(line.Text(), commandPrefix) {
+		return false
+	}
+	fields := strings.Fields(strings.TrimPrefix(line.Text(), commandPrefix))
+	if len(fields) == 0 {
+		return false
+	}
+	cmd, ok := commands[strings.ToLower(fields[0])]
+	if !ok {
+		return false
+	}
+	if cmd.owner && !isOwner(config, line) {
+		log.Printf("Denied %s to non-owner %s in %s\n", fields[0], line.Src, line.Target())
+		replyText(conn, line, line.Nick+": sorry, only my owners can do that.")
+		return true
+	}
+	if cmd.admin && !isAdmin(config, conn, line.Target(), line.Nick) {
+		log.Printf("Denied %s to %s in %s\n", fields[0], line.Nick, line.Target())
+		replyText(conn, line, line.Nick+": sorry, only channel operators can do that.")
+		return true
+	}
+	cmd.run(config, conn, line, fields[1:])
+	return true
+}
+
+// isAdmin reports whether nick is listed in AdminNicks or is an operator in channel
+func isAdmin(config Config, conn *irc.Conn, channel, nick string) bool {
+	for _, admin := range config.AdminNicks {
+		if strings.EqualFold(admin, nick) {
+			return true
+		}
+	}
+	if st := conn.StateTracker(); st != nil {
+		if privs, ok := st.IsOn(channel, nick); ok {
+			return privs.Owner || privs.Admin || privs.Op
+		}
+	}
+	return false
+}
+
+// isOwner reports whether the sender matches an owner hostmask or is logged in to an owner account
+func isOwner(config Config, line *irc.Line) bool {
+	for _, owner := range config.Owners {
+		if strings.ContainsAny(owner, "!@") {
+			if compileMask(owner).MatchString(line.Src) {
+				return true
+			}
+		} else if account := line.Tags["account"]; account != "" && strings.EqualFold(owner, account) {
+			return true
+		}
+	}
+	return false
+}
+
+// !reset clears the conversation context of the channel
+func cmdReset(config Config, conn *irc.Conn, line *irc.Line, args []string) {
+	channel := channelKey(config, line.Target())
+	contextMutex.Lock()
+	delete(contextMessagesPerChannel, channel)
+	delete(contextSummaries, channel)
+	delete(truncatedAnswers, channel)
+	contextMutex.Unlock()
+	log.Printf("Context of %s reset by %s\n", channel, line.Nick)
+	replyText(conn, line, "Context cleared.")
+}
+
+// !context reports how many messages are in the channel's context and how old the oldest is
+func cmdContext(config Config, conn *irc.Conn, line *irc.Line, args []string) {
+	channel := channelKey(config, line.Target())
+	contextMutex.Lock()
+	contextMessages := contextMessagesPerChannel[channel]
+	count := messageCount(contextMessages)
+	var oldest int64
+	for _, msg := range contextMessages {
+		if oldest == 0 || msg.Timestamp < oldest {
+			oldest = msg.Timestamp
+		}
+	}
+	evictions := ""
+	if counts, ok := contextEvictions[channel]; ok {
+		evictions = fmt.Sprintf(" Evicted since start: %d expired, %d over the limit.", counts.expired, counts.overflow)
+	}
+	contextMutex.Unlock()
+
+	if count == 0 {
+		replyText(conn, line, "Context is empty."+evictions)
+		return
+	}
+	age := time.Since(time.Unix(oldest, 0)).Round(time.Second)
+	replyText(conn, line, fmt.Sprintf("Context: %d messages, oldest from %s ago.", count, age)+evictions)
+}
+
+// !model [name|default] shows or switches the model used in the channel
+func cmdModel(config Config, conn *irc.Conn, line *irc.Line, args []string) {
+	channel := channelKey(config, line.Target())
+	if len(args) == 0 {
+		replyText(conn, line, fmt.Sprintf("Using %s. Available: %s", modelFor(config, channel), strings.Join(modelNames(), ", ")))
+		return
+	}
+	if strings.EqualFold(args[0], "default") {
+		setChannelModel(channel, "")
+		replyText(conn, line, fmt.Sprintf("Back to %s.", modelFor(config, channel)))
+		return
+	}
+	model, ok := resolveModel(args[0])
+	if !ok {
+		replyText(conn, line, fmt.Sprintf("Unknown model %s. Available: %s", args[0], strings.Join(modelNames(), ", ")))
+		return
+	}
+	setChannelModel(channel, model)
+	log.Printf("Model of %s set to %s by %s\n", channel, model, line.Nick)
+	replyText(conn, line, fmt.Sprintf("Now using %s.", model))
+}
+
+// !export writes the channel's context as JSON to a file and replies with its path
+func cmdExport(config Config, conn *irc.Conn, line *irc.Line, args []string) {
+	channel := channelKey(config, line.Target())
+	contextMutex.Lock()
+	data, err := json.MarshalIndent(contextMessagesPerChannel[channel], "", "  ")
+	contextMutex.Unlock()
+	if err != nil {
+		log.Printf("Error exporting context of %s: %v\n", channel, err)
+		replyText(conn, line, "Export failed.")
+		return
+	}
+
+	file, err := os.CreateTemp(config.ExportDir, "drgolang-context-*.json")
+	if err == nil {
+		_, err = file.Write(data)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		log.Printf("Error exporting context of %s: %v\n", channel, err)
+		replyText(conn, line, "Export failed.")
+		return
+	}
+	log.Printf("Context of %s exported to %s by %s\n", channel, file.Name(), line.Nick)
+	replyText(conn, line, "Context exported to "+file.Name())
+}
+
+// !shutdown quits all networks and stops the bot
+func cmdShutdown(config Config, conn *irc.Conn, line *irc.Line, args []string) {
+	log.Printf("Shutdown requested by %s\n", line.Src)
+	replyText(conn, line, "Shutting down, bye!")
+	requestShutdown("!shutdown by " + line.Src)
+}
+
+// !forgetme opts the sender out of the context and removes what is stored from them
+func cmdForgetMe(config Config, conn *irc.Conn, line *irc.Line, args []string) {
+	setOptedOut(line.Nick, true)
+	removed := forgetNick(line.Nick)
+	log.Printf("%s opted out of the context, %d prompts removed\n", line.Nick, removed)
+	replyText(conn, line, line.Nick+": okay, I won't keep your messages in my context anymore.")
+}
+
+// !rememberme reverts !forgetme
+func cmdRememberMe(config Config, conn *irc.Conn, line *irc.Line, args []string) {
+	setOptedOut(line.Nick, false)
+	replyText(conn, line, line.Nick+": okay, your messages are part of the conversation again.")
+}
+
+// !forget removes the sender's stored prompts and the answers to them
+func cmdForget(config Config, conn *irc.Conn, line *irc.Line, args []string) {
+	removed := forgetNick(line.Nick)
+	replyText(conn, line, fmt.Sprintf("%s: removed %d of your messages from my context.", line.Nick, removed))
+}
+
+// !regenerate answers the channel's last prompt again, replacing the previous answer or
+// retrying a failed one. Only the user who asked it may do so.
+func cmdRegenerate(config Config, conn *irc.Conn, line *irc.Line, args []string) {
+	channel := channelKey(config, line.Target())
+	contextMutex.Lock()
+	contextMessages := contextMessagesPerChannel[channel]
+	if len(contextMessages) == 0 {
+		contextMutex.Unlock()
+		replyText(conn, line, line.Nick+": there's nothing to regenerate.")
+		return
+	}
+	last := contextMessages[len(contextMessages)-1]
+	if !strings.EqualFold(last.Nick, line.Nick) {
+		contextMutex.Unlock()
+		replyText(conn, line, line.Nick+": only the one who asked last can regenerate the answer.")
+		return
+	}
+	// a prompt without response that isn't pending anymore failed and can be retried as well
+	if last.pending {
+		contextMutex.Unlock()
+		replyText(conn, line, line.Nick+": I'm still working on that one.")
+		return
+	}
+	// respond adds the prompt again with its new answer
+	contextMessagesPerChannel[channel] = contextMessages[:len(contextMessages)-1]
+	contextMutex.Unlock()
+
+	if budgetExceeded(channel, config.DailyTokenBudget) {
+		log.Printf("Token budget for %s reached\n", channel)
+		replyText(conn, line, "Sorry, my token budget for this channel is used up, try again tomorrow.")
+		return
+	}
+	text := unwrapUserContent(last.Content)
+	log.Printf("Regenerating answer to %s in %s\n", line.Nick, channel)
+	if !enqueuePrompt(config, channel, func() { answer(config, conn, line, channel, text) }) {
+		log.Printf("Prompt queue of %s is full, dropping regeneration for %s\n", channel, line.Nick)
+		conn.Notice(line.Nick, "Sorry, I'm too busy right now, please try again in a moment.")
+	}
+}
+
+// !continue asks for the rest of the channel's last answer if it hit the token limit
+func cmdContinue(config Config, conn *irc.Conn, line *irc.Line, args []string) {
+	channel := channelKey(config, line.Target())
+	contextMutex.Lock()
+	truncated := truncatedAnswers[channel]
+	contextMutex.Unlock()
+	if !truncated {
+		log.Printf("Nothing to continue in %s\n", channel)
+		return
+	}
+
+	if budgetExceeded(channel, config.DailyTokenBudget) {
+		log.Printf("Token budget for %s reached\n", channel)
+		replyText(conn, line, "Sorry, my token budget for this channel is used up, try again tomorrow.")
+		return
+	}
+	log.Printf("Continuing the last answer in %s for %s\n", channel, line.Nick)
+	if !enqueuePrompt(config, channel, func() { answer(config, conn, line, channel, continuePrompt) }) {
+		log.Printf("Prompt queue of %s is full, dropping continuation for %s\n", channel, line.Nick)
+		conn.Notice(line.Nick, "Sorry, I'm too busy right now, please try again in a moment.")
+	}
+}
+
+// !length [chars|default] shows or sets the target answer length in the channel
+func cmdLength(config Config, conn *irc.Conn, line *irc.Line, args []string) {
+	channel := channelKey(config, line.Target())
+	if len(args) == 0 {
+		replyText(conn, line, fmt.Sprintf("Answers aim for %d characters.", answerLength(channel)))
+		return
+	}
+	if strings.EqualFold(args[0], "default") {
+		setAnswerLength(channel, 0)
+		replyText(conn, line, fmt.Sprintf("Back to %d characters.", answerLength(channel)))
+		return
+	}
+	length, err := strconv.Atoi(args[0])
+	if err != nil || length < 1 || length > maxAnswerLength {
+		replyText(conn, line, fmt.Sprintf("Usage: !length <1-%d|default>", maxAnswerLength))
+		return
+	}
+	setAnswerLength(channel, length)
+	log.Printf("Answer length of %s set to %d by %s\n", channel, length, line.Nick)
+	replyText(conn, line, fmt.Sprintf("Answers now aim for %d characters.", length))
+}
+
+// !config sends the effective configuration to the sender in private, with secrets redacted
+func cmdConfig(config Config, conn *irc.Conn, line *irc.Line, args []string) {
+	channel := channelKey(config, line.Target())
+	settings, err := redactedSettings(config)
+	if err != nil {
+		log.Printf("Error showing config: %v\n", err)
+		deliver(conn, line.Nick, "", "Can't show the config, see the log.")
+		return
+	}
+	log.Printf("Config shown to %s\n", line.Src)
+
+	effective := fmt.Sprintf("In %s: model=%s max_tokens=%d answer_length=%d context_ttl=2h max_context_messages=%d backend=%s",
+		line.Target(), modelFor(config, channel), answerTokens(channel), answerLength(channel), maxContextMessages, config.Backend)
+	payload := maxPayload(config, conn, line.Nick)
+	for _, text := range append([]string{effective}, splitLine(strings.Join(settings, ", "), payload)...) {
+		if err := deliver(conn, line.Nick, "", text); err != nil {
+			return
+		}
+	}
+}
+
+// redactedSettings lists the set configuration values as key=value, replacing secrets with ***
+func redactedSettings(config Config) ([]string, error) {
+	config.SystemPrompt = fmt.Sprintf("(%d characters)", len(currentSystemPrompt(config)))
+	// config is a copy, but its slices and maps are shared with the live config
+	config.Networks = append([]NetworkConfig(nil), config.Networks...)
+	config.IrcChannels = withoutChannelKeys(config.IrcChannels)
+	for i := range config.Networks {
+		config.Networks[i].IrcPassword = redact(config.Networks[i].IrcPassword)
+		config.Networks[i].IrcChannels = withoutChannelKeys(config.Networks[i].IrcChannels)
+	}
+	keys := make(map[string]string)
+	for channel, key := range config.ChannelKeys {
+		keys[channel] = redact(key)
+	}
+	config.ChannelKeys = keys
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	var settings []string
+	for key, value := range values {
+		switch string(value) {
+		case "null", `""`, "0", "false", "[]", "{}":
+			continue
+		}
+		if secretSettings[key] {
+			value = json.RawMessage(`"***"`)
+		}
+		settings = append(settings, key+"="+string(value))
+	}
+	sort.Strings(settings)
+	return settings, nil
+}
+
+// withoutChannelKeys returns the channel entries with their +k keys redacted
+func withoutChannelKeys(entries []string) []string {
+	var channels []string
+	for _, entry := range entries {
+		channel, key := parseChannel(entry)
+		if key != "" {
+			channel += " " + redact(key)
+		}
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "***"
+}
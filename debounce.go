@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// prompts of a (channel, nick) waiting for the user to stop typing
+type pendingPrompt struct {
+	texts []string
+	timer *time.Timer
+}
+
+var pendingPrompts = struct {
+	sync.Mutex
+	prompts map[string]*pendingPrompt
+}{prompts: make(map[string]*pendingPrompt)}
+
+// debounce collects a user's prompts in a channel until they have been quiet for the
+// configured period, then passes them to submit as one prompt
+func debounce(config Config, channel, nick, text string, submit func(string)) {
+	quiet := time.Duration(config.DebounceMillis) * time.Millisecond
+	key := channel + "\x00" + strings.ToLower(nick)
+
+	pendingPrompts.Lock()
+	defer pendingPrompts.Unlock()
+	// a timer that can't be stopped has already fired and submits its prompts by itself
+	if pending, ok := pendingPrompts.prompts[key]; ok && pending.timer.Stop() {
+		pending.texts = append(pending.texts, text)
+		pending.timer.Reset(quiet)
+		return
+	}
+	pending := &pendingPrompt{texts: []string{text}}
+	pending.timer = time.AfterFunc(quiet, func() {
+		pendingPrompts.Lock()
+		if pendingPrompts.prompts[key] == pending {
+			delete(pendingPrompts.prompts, key)
+		}
+		texts := pending.texts
+		pendingPrompts.Unlock()
+		if len(texts) > 1 {
+			log.Printf("Combining %d prompts from %s in %s\n", len(texts), nick, channel)
+		}
+		submit(strings.Join(texts, "\n"))
+	})
+	pendingPrompts.prompts[key] = pending
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultDedupWindow = 3 * time.Second
+
+// recentPrompts remembers when a (channel, nick, text) prompt was last seen
+var recentPrompts = struct {
+	sync.Mutex
+	seen map[string]time.Time
+}{seen: make(map[string]time.Time)}
+
+// isDuplicate reports whether the same prompt arrived within the window, and records it otherwise
+func isDuplicate(channel, nick, text string, window time.Duration) bool {
+	if window <= 0 {
+		return false
+	}
+	key := channel + "\x00" + nick + "\x00" + text
+	now := time.Now()
+
+	recentPrompts.Lock()
+	defer recentPrompts.Unlock()
+
+	// forget prompts that are outside the window
+	for k, t := range recentPrompts.seen {
+		if now.Sub(t) > window {
+			delete(recentPrompts.seen, k)
+		}
+	}
+
+	if _, ok := recentPrompts.seen[key]; ok {
+		return true
+	}
+	recentPrompts.seen[key] = now
+	return false
+}
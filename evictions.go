@@ -0,0 +1,24 @@
+package main
+
+// evictionCounts counts context turns (a prompt and its response) removed from a channel since startup
+type evictionCounts struct {
+	expired  int // older than the context TTL
+	overflow int // trimmed to stay within maxContextMessages
+}
+
+// context evictions per channel, guarded by contextMutex
+var contextEvictions = make(map[string]*evictionCounts)
+
+// countEvictions adds to the channel's eviction counters; the caller holds contextMutex
+func countEvictions(channel string, expired, overflow int) {
+	if expired == 0 && overflow == 0 {
+		return
+	}
+	counts, ok := contextEvictions[channel]
+	if !ok {
+		counts = &evictionCounts{}
+		contextEvictions[channel] = counts
+	}
+	counts.expired += expired
+	counts.overflow += overflow
+}
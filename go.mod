@@ -4,10 +4,13 @@ go 1.21
 
 toolchain go1.22.3
 
+require (
+	github.com/fluffle/goirc v1.3.1
+	github.com/liushuangls/go-anthropic/v2 v2.1.0
+)
+
 require (
 	github.com/emersion/go-sasl v0.0.0-20220912192320-0145f2c60ead // indirect
-	github.com/fluffle/goirc v1.3.1 // indirect
 	github.com/golang/mock v1.5.0 // indirect
-	github.com/liushuangls/go-anthropic/v2 v2.1.0 // indirect
 	golang.org/x/net v0.18.0 // indirect
 )
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// keys whose lists are concatenated when merging included config files; other keys are overridden
+var concatenatedKeys = map[string]bool{
+	"irc_channels": true,
+	"networks":     true,
+}
+
+// loadConfigFile reads a JSON config file and merges the files of its "include" list into it,
+// later files overriding earlier ones. Include paths are relative to the including file.
+// stack holds the files currently being loaded, to detect include cycles.
+func loadConfigFile(path string, stack []string) (map[string]json.RawMessage, error) {
+	absolute, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	for i, loading := range stack {
+		if loading == absolute {
+			cycle := append(stack[i:], absolute)
+			return nil, fmt.Errorf("include cycle: %s", strings.Join(cycle, " -> "))
+		}
+	}
+	stack = append(stack, absolute)
+
+	data, err := os.ReadFile(absolute)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	var includes []string
+	if raw, ok := values["include"]; ok {
+		if err := json.Unmarshal(raw, &includes); err != nil {
+			return nil, fmt.Errorf("%s: include must be a list of file names: %w", path, err)
+		}
+		delete(values, "include")
+	}
+	for _, include := range includes {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(absolute), include)
+		}
+		included, err := loadConfigFile(include, stack)
+		if err != nil {
+			return nil, err
+		}
+		if err := mergeConfig(values, included); err != nil {
+			return nil, fmt.Errorf("%s: %w", include, err)
+		}
+	}
+	return values, nil
+}
+
+// mergeConfig merges the values of an included file into values
+func mergeConfig(values, included map[string]json.RawMessage) error {
+	for key, value := range included {
+		existing, ok := values[key]
+		if !ok || !concatenatedKeys[key] {
+			values[key] = value
+			continue
+		}
+		var list, more []json.RawMessage
+		if err := json.Unmarshal(existing, &list); err != nil {
+			return fmt.Errorf("%s must be a list: %w", key, err)
+		}
+		if err := json.Unmarshal(value, &more); err != nil {
+			return fmt.Errorf("%s must be a list: %w", key, err)
+		}
+		merged, err := json.Marshal(append(list, more...))
+		if err != nil {
+			return err
+		}
+		values[key] = merged
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sync"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+// connections that have joined their channels since connecting, so repeated
+// "You are now identified" notices don't cause another round of joins. The round
+// counts disconnects, so joins still running for an earlier connection can stop.
+var joinedConnections = struct {
+	sync.Mutex
+	joined map[*irc.Conn]bool
+	round  map[*irc.Conn]int
+}{joined: make(map[*irc.Conn]bool), round: make(map[*irc.Conn]int)}
+
+// channels greeted with the join message, once per process rather than on every rejoin
+var greetedChannels = struct {
+	sync.Mutex
+	greeted map[string]bool
+}{greeted: make(map[string]bool)}
+
+// markJoined records that conn joins its channels and reports whether it hadn't yet,
+// along with the round to pass to stillJoining
+func markJoined(conn *irc.Conn) (bool, int) {
+	joinedConnections.Lock()
+	defer joinedConnections.Unlock()
+	if joinedConnections.joined[conn] {
+		return false, 0
+	}
+	joinedConnections.joined[conn] = true
+	return true, joinedConnections.round[conn]
+}
+
+// stillJoining reports whether conn is still on the connection its joins started on
+func stillJoining(conn *irc.Conn, round int) bool {
+	if !conn.Connected() {
+		return false
+	}
+	joinedConnections.Lock()
+	defer joinedConnections.Unlock()
+	return joinedConnections.round[conn] == round
+}
+
+// resetJoined forgets the joins of conn when it disconnects, so they happen again after reconnecting
+func resetJoined(conn *irc.Conn, line *irc.Line) {
+	joinedConnections.Lock()
+	defer joinedConnections.Unlock()
+	delete(joinedConnections.joined, conn)
+	joinedConnections.round[conn]++
+}
+
+// markGreeted records that the channel gets the join message and reports whether it hadn't yet
+func markGreeted(channel string) bool {
+	greetedChannels.Lock()
+	defer greetedChannels.Unlock()
+	if greetedChannels.greeted[channel] {
+		return false
+	}
+	greetedChannels.greeted[channel] = true
+	return true
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"sync"
+)
+
+const defaultAnswerLength = 200 // characters
+const maxAnswerLength = 2000
+
+// per-channel answer length overrides set with !length; not persisted across restarts
+var channelLengths = struct {
+	sync.RWMutex
+	lengths map[string]int
+}{lengths: make(map[string]int)}
+
+// answerLength returns the target answer length in characters for a channel
+func answerLength(channel string) int {
+	channelLengths.RLock()
+	defer channelLengths.RUnlock()
+	if length, ok := channelLengths.lengths[channel]; ok {
+		return length
+	}
+	return defaultAnswerLength
+}
+
+// setAnswerLength sets the channel's answer length; 0 restores the default
+func setAnswerLength(channel string, length int) {
+	channelLengths.Lock()
+	defer channelLengths.Unlock()
+	if length == 0 {
+		delete(channelLengths.lengths, channel)
+	} else {
+		channelLengths.lengths[channel] = length
+	}
+}
+
+// answerTokens returns max_tokens for a channel, growing with its answer length so
+// longer answers aren't cut off
+func answerTokens(channel string) int {
+	return max(maxTokens, answerLength(channel)/2)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+const defaultRequestQueueWait = 10 * time.Second
+
+var errTooBusy = errors.New("too many concurrent requests")
+
+// requestSlots limits the number of in-flight Anthropic requests; nil means unlimited
+var requestSlots chan struct{}
+
+// initRequestSlots sets up the concurrency limit from the config
+func initRequestSlots(config Config) {
+	if config.MaxConcurrentRequests > 0 {
+		requestSlots = make(chan struct{}, config.MaxConcurrentRequests)
+	}
+}
+
+// acquireRequestSlot waits briefly for a free slot and returns errTooBusy if none frees up
+func acquireRequestSlot() error {
+	if requestSlots == nil {
+		return nil
+	}
+	timer := time.NewTimer(defaultRequestQueueWait)
+	defer timer.Stop()
+	select {
+	case requestSlots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return errTooBusy
+	}
+}
+
+func releaseRequestSlot() {
+	if requestSlots != nil {
+		<-requestSlots
+	}
+}
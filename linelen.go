@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+// server line length per RFC 1459, including the prefix and CRLF, used unless the server
+// advertises LINELEN or line_length is configured
+const defaultLineLength = 512
+
+// lengths assumed for our own user and host while the server hasn't told us yet (USERLEN, HOSTLEN)
+const assumedUserLength = 10
+const assumedHostLength = 63
+
+// line lengths advertised in ISUPPORT, per connection
+var lineLengths = struct {
+	sync.Mutex
+	lengths map[*irc.Conn]int
+}{lengths: make(map[*irc.Conn]int)}
+
+// handleISupport records the LINELEN token of the server's 005 ISUPPORT replies
+func handleISupport(conn *irc.Conn, line *irc.Line) {
+	// the first argument is our nick and the last one the trailing "are supported by this server"
+	if len(line.Args) < 3 {
+		return
+	}
+	for _, token := range line.Args[1 : len(line.Args)-1] {
+		value, found := strings.CutPrefix(token, "LINELEN=")
+		if !found {
+			continue
+		}
+		if length, err := strconv.Atoi(value); err == nil && length > 0 {
+			lineLengths.Lock()
+			lineLengths.lengths[conn] = length
+			lineLengths.Unlock()
+		}
+	}
+}
+
+// lineLength returns the maximum line length of the connection's server
+func lineLength(config Config, conn *irc.Conn) int {
+	lineLengths.Lock()
+	length, ok := lineLengths.lengths[conn]
+	lineLengths.Unlock()
+	if ok {
+		return length
+	}
+	if config.LineLength > 0 {
+		return config.LineLength
+	}
+	return defaultLineLength
+}
+
+// maxPayload returns how many bytes of text fit in a PRIVMSG to target, after the server
+// prepends our ":nick!user@host" prefix when relaying it
+func maxPayload(config Config, conn *irc.Conn, target string) int {
+	me := conn.Me()
+	userLength, hostLength := len(me.Ident), len(me.Host)
+	if userLength == 0 {
+		userLength = assumedUserLength
+	}
+	if hostLength == 0 {
+		hostLength = assumedHostLength
+	}
+	prefix := 1 + len(me.Nick) + 1 + userLength + 1 + hostLength
+	overhead := prefix + len(" PRIVMSG ") + len(target) + len(" :") + len("\r\n")
+	return min(lineLength(config, conn)-overhead, maxIRCMessageLength)
+}
+
+// splitLine cuts text into pieces of at most limit bytes, preferring to break at spaces
+// and never splitting a UTF-8 character
+func splitLine(text string, limit int) []string {
+	if limit <= 0 {
+		return []string{text}
+	}
+	var pieces []string
+	for len(text) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		if space := strings.LastIndex(text[:cut], " "); space > 0 {
+			cut = space
+		} else if cut == 0 {
+			cut = limit
+		}
+		pieces = append(pieces, text[:cut])
+		text = strings.TrimLeft(text[cut:], " ")
+	}
+	return append(pieces, text)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+const defaultPingTimeout = 5 * time.Minute
+
+// events that count as a sign of life from the server
+var livenessEvents = []string{irc.PING, irc.PONG, irc.PRIVMSG, irc.NOTICE, irc.JOIN, irc.PART, irc.QUIT, irc.NICK, irc.MODE}
+
+// watchdog tracks when the server last sent something. After half the timeout without
+// any line it sends a PING; after the full timeout it closes the half-open connection
+// and marks it stale so runNetwork reconnects.
+type watchdog struct {
+	timeout  time.Duration
+	lastSeen atomic.Int64
+	stale    atomic.Bool
+
+	mu   sync.Mutex
+	stop chan struct{}
+}
+
+func newWatchdog(config Config) *watchdog {
+	timeout := defaultPingTimeout
+	if config.PingTimeoutSeconds > 0 {
+		timeout = time.Duration(config.PingTimeoutSeconds) * time.Second
+	}
+	return &watchdog{timeout: timeout}
+}
+
+// register installs the handlers that feed and control the watchdog
+func (w *watchdog) register(client *irc.Conn) {
+	for _, event := range livenessEvents {
+		client.HandleFunc(event, func(conn *irc.Conn, line *irc.Line) { w.touch() })
+	}
+	client.HandleFunc(irc.CONNECTED, func(conn *irc.Conn, line *irc.Line) { w.start(conn) })
+	client.HandleFunc(irc.DISCONNECTED, func(conn *irc.Conn, line *irc.Line) { w.halt() })
+}
+
+func (w *watchdog) touch() {
+	w.lastSeen.Store(time.Now().UnixNano())
+}
+
+func (w *watchdog) start(conn *irc.Conn) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stop != nil {
+		close(w.stop)
+	}
+	w.stop = make(chan struct{})
+	w.touch()
+	go w.run(conn, w.stop)
+}
+
+func (w *watchdog) halt() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stop != nil {
+		close(w.stop)
+		w.stop = nil
+	}
+}
+
+func (w *watchdog) run(conn *irc.Conn, stop chan struct{}) {
+	ticker := time.NewTicker(w.timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			idle := time.Since(time.Unix(0, w.lastSeen.Load()))
+			if idle >= w.timeout {
+				log.Printf("Nothing received from %s for %s, reconnecting\n", conn.Config().Server, idle.Round(time.Second))
+				w.stale.Store(true)
+				if err := conn.Close(); err != nil {
+					log.Printf("Error closing stale connection: %v\n", err)
+				}
+				return
+			}
+			if idle >= w.timeout/2 {
+				conn.Ping(strconv.FormatInt(time.Now().UnixNano(), 10))
+			}
+		}
+	}
+}
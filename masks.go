@@ -0,0 +1,47 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// ignoreMasks are compiled from Config.IgnoreMasks at startup
+var ignoreMasks []*regexp.Regexp
+
+// compileMask turns an IRC hostmask glob like "*bot*!*@*.example.com" into a case-insensitive
+// regular expression. "*" matches any sequence of characters, "?" matches exactly one
+// character, everything else matches literally.
+func compileMask(mask string) *regexp.Regexp {
+	var pattern strings.Builder
+	pattern.WriteString("(?i)^")
+	for _, r := range mask {
+		switch r {
+		case '*':
+			pattern.WriteString(".*")
+		case '?':
+			pattern.WriteString(".")
+		default:
+			pattern.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	pattern.WriteString("$")
+	return regexp.MustCompile(pattern.String())
+}
+
+func compileMasks(masks []string) []*regexp.Regexp {
+	var compiled []*regexp.Regexp
+	for _, mask := range masks {
+		compiled = append(compiled, compileMask(mask))
+	}
+	return compiled
+}
+
+// matchesMask reports whether the source nick!user@host matches any of the masks
+func matchesMask(masks []*regexp.Regexp, src string) bool {
+	for _, mask := range masks {
+		if mask.MatchString(src) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	anthropic "github.com/liushuangls/go-anthropic/v2"
+)
+
+const defaultModel = anthropic.ModelClaude3Haiku20240307
+
+// models that may be selected, by short name
+var modelAliases = map[string]string{
+	"haiku":  anthropic.ModelClaude3Haiku20240307,
+	"sonnet": anthropic.ModelClaude3Sonnet20240229,
+	"opus":   anthropic.ModelClaude3Opus20240229,
+}
+
+// per-channel model overrides set with !model; not persisted across restarts
+var channelModels = struct {
+	sync.RWMutex
+	models map[string]string
+}{models: make(map[string]string)}
+
+// resolveModel maps a short name or full model id from the allowlist to the model id
+func resolveModel(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if model, ok := modelAliases[name]; ok {
+		return model, true
+	}
+	for _, model := range modelAliases {
+		if model == name {
+			return model, true
+		}
+	}
+	return "", false
+}
+
+// modelNames lists the short names of the allowed models
+func modelNames() []string {
+	var names []string
+	for name := range modelAliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// modelFor returns the model to use in a channel: its override, the configured model or the default
+func modelFor(config Config, channel string) string {
+	channelModels.RLock()
+	model, ok := channelModels.models[channel]
+	channelModels.RUnlock()
+	if ok {
+		return model
+	}
+	if model, ok := resolveModel(config.Model); ok {
+		return model
+	}
+	return defaultModel
+}
+
+// setChannelModel sets the channel's model override; an empty model removes it
+func setChannelModel(channel, model string) {
+	channelModels.Lock()
+	defer channelModels.Unlock()
+	if model == "" {
+		delete(channelModels.models, channel)
+	} else {
+		channelModels.models[channel] = model
+	}
+}
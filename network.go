@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+// pauses between failed reconnects, doubling up to the maximum
+const minReconnectBackoff = 5 * time.Second
+const maxReconnectBackoff = 5 * time.Minute
+
+// NetworkConfig describes one IRC network the bot connects to
+type NetworkConfig struct {
+	Name         string   `json:"name"`
+	SystemPrompt string   `json:"system_prompt"` // optional, overrides the top-level system prompt
+	IrcServer    string   `json:"irc_server"`
+	IrcPort      int      `json:"irc_port"`
+	IrcNick      string   `json:"irc_nick"`
+	IrcPassword  string   `json:"irc_password"`
+	IrcChannels  []string `json:"irc_channels"`
+}
+
+// networks returns one effective configuration per network. Without a networks list,
+// the top-level IRC settings form the only network.
+func (config Config) networks() []Config {
+	if len(config.Networks) == 0 {
+		return []Config{config}
+	}
+	var result []Config
+	for _, network := range config.Networks {
+		c := config
+		c.Networks = nil
+		c.Network = network.Name
+		c.IrcServer = network.IrcServer
+		c.IrcPort = network.IrcPort
+		c.IrcNick = network.IrcNick
+		c.IrcPassword = network.IrcPassword
+		c.IrcChannels = network.IrcChannels
+		if network.SystemPrompt != "" {
+			c.SystemPrompt = network.SystemPrompt
+		}
+		result = append(result, c)
+	}
+	return result
+}
+
+// channelKey returns the key for per-channel state: the normalized channel name, qualified
+// by network so channels with the same name on different networks don't share context
+func channelKey(config Config, channel string) string {
+	channel = normalizeChannel(channel)
+	if config.Network == "" {
+		return channel
+	}
+	return config.Network + "/" + channel
+}
+
+// channelName returns the normalized channel name of a channelKey, without the network qualifier
+func channelName(config Config, key string) string {
+	return strings.TrimPrefix(key, channelKey(config, ""))
+}
+
+// rfc1459Lower maps upper to lower case per RFC 1459 casemapping, where []\~ are the
+// upper case forms of {}|^
+var rfc1459Lower = strings.NewReplacer("[", "{", "]", "}", "\\", "|", "~", "^")
+
+// normalizeChannel returns the canonical form of a channel name, so differently cased
+// spellings of a channel map to the same key
+func normalizeChannel(channel string) string {
+	return rfc1459Lower.Replace(strings.ToLower(channel))
+}
+
+// runNetwork connects to the network's IRC server and blocks until disconnected
+func runNetwork(config Config) {
+	// Create irc client configuration
+	ircConfig := irc.NewConfig(config.IrcNick, config.IrcNick, config.IrcNick)
+	ircConfig.SSL = true
+	ircConfig.SSLConfig = &tls.Config{ServerName: config.IrcServer}
+	ircConfig.Server = fmt.Sprintf("%s:%d", config.IrcServer, config.IrcPort)
+	ircConfig.NewNick = newNickFunc(config)
+	// account-tag tells us the NickServ account of senders, used to verify owners;
+	// message-tags gives us message ids to thread replies with
+	ircConfig.EnableCapabilityNegotiation = true
+	ircConfig.Capabilites = []string{"account-tag", messageTagsCap}
+	ircConfig.Recover = recoverHandler
+	ircConfig.Version = botVersion
+	if config.CtcpVersion != "" {
+		ircConfig.Version = config.CtcpVersion
+	}
+
+	ircClient := irc.Client(ircConfig)
+	registerClient(ircClient)
+	ircClient.EnableStateTracking()
+	ircClient.HandleFunc(irc.CONNECTED, handleConnected(ircConfig, config))
+	ircClient.HandleFunc(irc.NOTICE, handleNotice(config))
+	ircClient.HandleFunc(irc.PRIVMSG, handlePrivMsg(config))
+	ircClient.HandleFunc(irc.CTCP, handleCtcp)
+	ircClient.HandleFunc("005", handleISupport)
+	ircClient.HandleFunc(irc.DISCONNECTED, resetJoined)
+
+	watch := newWatchdog(config)
+	watch.register(ircClient)
+	newNickReclaimer(config).register(ircClient)
+
+	// Create a signal on disconnect to wait for. It is buffered and sent without blocking,
+	// so extra disconnect events never leave a handler goroutine stuck.
+	quit := make(chan struct{}, 1)
+	ircClient.HandleFunc(irc.DISCONNECTED, func(conn *irc.Conn, line *irc.Line) {
+		select {
+		case quit <- struct{}{}:
+		default:
+		}
+	})
+
+	reconnecting := false
+	backoff := minReconnectBackoff
+	for {
+		// drop a leftover signal from an earlier connection
+		select {
+		case <-quit:
+		default:
+		}
+
+		// Tell irc client to connect. The first connection has to succeed, reconnects are
+		// retried with growing pauses as the network may be down for a while.
+		if err := ircClient.Connect(); err != nil {
+			log.Printf("Connection error: %s\n", err.Error())
+			if !reconnecting {
+				return
+			}
+			log.Printf("Retrying %s in %s\n", ircConfig.Server, backoff)
+			time.Sleep(backoff)
+			backoff = min(2*backoff, maxReconnectBackoff)
+			continue
+		}
+		backoff = minReconnectBackoff
+
+		// Wait for disconnect, reconnecting only if the watchdog dropped a dead connection
+		<-quit
+		if !watch.stale.Swap(false) {
+			return
+		}
+		reconnecting = true
+		log.Printf("Reconnecting to %s...\n", ircConfig.Server)
+	}
+}
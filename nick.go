@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+const defaultNickSuffix = "_"
+const defaultNickReclaimInterval = time.Minute
+
+// newNickFunc returns the nick collision strategy: append NickSuffix, and once MaxNickLength
+// is reached cycle the last character instead of growing the nick further
+func newNickFunc(config Config) func(string) string {
+	suffix := config.NickSuffix
+	if suffix == "" {
+		suffix = defaultNickSuffix
+	}
+	return func(nick string) string {
+		if config.MaxNickLength <= 0 || len(nick)+len(suffix) <= config.MaxNickLength {
+			return nick + suffix
+		}
+		if len(nick) > config.MaxNickLength {
+			nick = nick[:config.MaxNickLength]
+		}
+		return irc.DefaultNewNick(nick)
+	}
+}
+
+// nickReclaimer periodically tries to get the primary nick back while connected under another one
+type nickReclaimer struct {
+	config   Config
+	interval time.Duration
+
+	mu   sync.Mutex
+	stop chan struct{}
+}
+
+func newNickReclaimer(config Config) *nickReclaimer {
+	interval := defaultNickReclaimInterval
+	if config.NickReclaimSeconds > 0 {
+		interval = time.Duration(config.NickReclaimSeconds) * time.Second
+	}
+	return &nickReclaimer{config: config, interval: interval}
+}
+
+// register installs the handlers that start and stop reclaiming with the connection
+func (r *nickReclaimer) register(client *irc.Conn) {
+	client.HandleFunc(irc.CONNECTED, func(conn *irc.Conn, line *irc.Line) { r.start(conn) })
+	client.HandleFunc(irc.DISCONNECTED, func(conn *irc.Conn, line *irc.Line) { r.halt() })
+}
+
+func (r *nickReclaimer) start(conn *irc.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stop != nil {
+		close(r.stop)
+	}
+	r.stop = make(chan struct{})
+	go r.run(conn, r.stop)
+}
+
+func (r *nickReclaimer) halt() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+}
+
+func (r *nickReclaimer) run(conn *irc.Conn, stop chan struct{}) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	regained := false
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if conn.Me().Nick == r.config.IrcNick {
+				continue
+			}
+			log.Printf("Trying to reclaim nick %s (currently %s)\n", r.config.IrcNick, conn.Me().Nick)
+			// ask services to free the nick once per connection, then just keep trying to switch
+			if !regained && r.config.IrcPassword != "" {
+				conn.Privmsg("NickServ", "REGAIN "+r.config.IrcNick+" "+r.config.IrcPassword)
+				regained = true
+			} else {
+				conn.Nick(r.config.IrcNick)
+			}
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	anthropic "github.com/liushuangls/go-anthropic/v2"
+)
+
+const openAITimeout = 2 * time.Minute
+
+var openAIHTTPClient = &http.Client{Timeout: openAITimeout}
+
+type openAIMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type openAIRequest struct {
+	Model       string          `json:"model"`
+	Messages    []openAIMessage `json:"messages"`
+	MaxTokens   int             `json:"max_tokens"`
+	Temperature *float32        `json:"temperature,omitempty"`
+	TopP        *float32        `json:"top_p,omitempty"`
+}
+
+type openAIResponse struct {
+	Choices []struct {
+		Message      openAIMessage `json:"message"`
+		FinishReason string        `json:"finish_reason"`
+	} `json:"choices"`
+	Usage struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+// openAIError is a non-2xx response from an OpenAI-compatible endpoint
+type openAIError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *openAIError) Error() string {
+	return fmt.Sprintf("openai backend: status %d: %s", e.StatusCode, e.Body)
+}
+
+// openAIResponder answers with an OpenAI-compatible chat completions endpoint, such as
+// Ollama or llama.cpp. It doesn't stream or run tools.
+type openAIResponder struct {
+	config    Config
+	channel   string
+	maxTokens int
+
+	used anthropic.MessagesUsage
+	cut  bool
+}
+
+func (r *openAIResponder) Generate(ctx context.Context, system string, messages []anthropic.Message) (string, error) {
+	request := openAIRequest{
+		Model:     r.config.OpenAIModel,
+		Messages:  []openAIMessage{{Role: "system", Content: system}},
+		MaxTokens: r.maxTokens,
+	}
+	for _, msg := range messages {
+		request.Messages = append(request.Messages, openAIMessage{Role: msg.Role, Content: messageText(msg)})
+	}
+	request.Temperature, request.TopP = modelParams(r.config, r.channel)
+	body, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+
+	url := strings.TrimSuffix(r.config.OpenAIBaseURL, "/") + "/chat/completions"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.config.OpenAIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+r.config.OpenAIKey)
+	}
+
+	start := time.Now()
+	resp, err := openAIHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func(body io.ReadCloser) {
+		if err := body.Close(); err != nil {
+			log.Printf("Failed to close response body: %v", err)
+		}
+	}(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", &openAIError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(detail))}
+	}
+
+	var completion openAIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+		return "", fmt.Errorf("openai backend: decoding response: %w", err)
+	}
+	r.used = anthropic.MessagesUsage{
+		InputTokens:  completion.Usage.PromptTokens,
+		OutputTokens: completion.Usage.CompletionTokens,
+	}
+	if r.config.LogUsage {
+		log.Printf("Usage %s: model=%s input=%d output=%d latency=%s\n", r.channel, request.Model,
+			r.used.InputTokens, r.used.OutputTokens, time.Since(start).Round(time.Millisecond))
+	}
+	if len(completion.Choices) == 0 {
+		return "", fmt.Errorf("openai backend: response has no choices")
+	}
+	r.cut = completion.Choices[0].FinishReason == "length"
+	content := completion.Choices[0].Message.Content
+	log.Printf("OpenAI backend response from %s: %s\n", request.Model, content)
+	return content, nil
+}
+
+func (r *openAIResponder) usage() anthropic.MessagesUsage {
+	return r.used
+}
+
+func (r *openAIResponder) fallbackMarker() string {
+	return ""
+}
+
+func (r *openAIResponder) truncated() bool {
+	return r.cut
+}
+
+// messageText joins the text blocks of a message
+func messageText(msg anthropic.Message) string {
+	var parts []string
+	for _, block := range msg.Content {
+		if block.Type == anthropic.MessagesContentTypeText && block.Text != nil {
+			parts = append(parts, *block.Text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
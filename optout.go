@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// nicks of users who asked not to be kept in context; not persisted across restarts
+var optedOut = struct {
+	sync.RWMutex
+	nicks map[string]bool
+}{nicks: make(map[string]bool)}
+
+func isOptedOut(nick string) bool {
+	optedOut.RLock()
+	defer optedOut.RUnlock()
+	return optedOut.nicks[strings.ToLower(nick)]
+}
+
+func setOptedOut(nick string, out bool) {
+	optedOut.Lock()
+	defer optedOut.Unlock()
+	if out {
+		optedOut.nicks[strings.ToLower(nick)] = true
+	} else {
+		delete(optedOut.nicks, strings.ToLower(nick))
+	}
+}
+
+// forgetNick removes the nick's prompts and the answers to them from all channel contexts,
+// returning how many prompts were removed. Summaries that include the nick's prompts are
+// dropped, as they can't be edited.
+func forgetNick(nick string) int {
+	contextMutex.Lock()
+	defer contextMutex.Unlock()
+	removed := 0
+	for channel, contextMessages := range contextMessagesPerChannel {
+		var kept []*ContextMessage
+		for _, msg := range contextMessages {
+			if strings.EqualFold(msg.Nick, nick) {
+				removed++
+				continue
+			}
+			kept = append(kept, msg)
+		}
+		contextMessagesPerChannel[channel] = kept
+	}
+	for channel, summary := range contextSummaries {
+		var backlog []*ContextMessage
+		for _, msg := range summary.backlog {
+			if strings.EqualFold(msg.Nick, nick) {
+				removed++
+				continue
+			}
+			backlog = append(backlog, msg)
+		}
+		if summary.nicks[strings.ToLower(nick)] {
+			// a summary still being generated is discarded along with the old entry
+			summary.backlog = nil
+			contextSummaries[channel] = &channelSummary{nicks: make(map[string]bool), backlog: backlog}
+		} else {
+			summary.backlog = backlog
+		}
+	}
+	return removed
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"log"
+	"runtime"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+const panicReply = "Oops, something went wrong on my side."
+
+// recoverHandler replaces goirc's panic handler, which logs nothing unless goirc's logging
+// is set up. It logs the panic with its stack trace and apologizes for failed prompts.
+func recoverHandler(conn *irc.Conn, line *irc.Line) {
+	if err := recover(); err != nil {
+		logPanic("handling "+line.Cmd, err)
+		if line.Cmd == irc.PRIVMSG {
+			deliver(conn, replyTarget(line), line.Tags["msgid"], panicReply)
+		}
+	}
+}
+
+// runJob runs a queued prompt, recovering from a panic so the worker keeps serving the channel
+func runJob(channel string, job func()) {
+	defer func() {
+		if err := recover(); err != nil {
+			logPanic("answering in "+channel, err)
+		}
+	}()
+	job()
+}
+
+// logPanic logs a recovered panic with the stack trace of the panicking goroutine
+func logPanic(what string, err any) {
+	stack := make([]byte, 64*1024)
+	stack = stack[:runtime.Stack(stack, false)]
+	log.Printf("Panic %s: %v\n%s", what, err, stack)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+func TestRunJobRecovers(t *testing.T) {
+	ran := false
+	runJob("#test", func() { panic("boom") })
+	runJob("#test", func() { ran = true })
+	if !ran {
+		t.Error("job after a panicking job didn't run")
+	}
+}
+
+func TestRecoverHandler(t *testing.T) {
+	conn := irc.SimpleClient("DrGolang")
+	for _, line := range []*irc.Line{
+		{Cmd: irc.PRIVMSG, Nick: "alice", Args: []string{"#test", "DrGolang: hi"}},
+		{Cmd: irc.NOTICE, Nick: "NickServ", Args: []string{"DrGolang", "hello"}},
+	} {
+		func() {
+			defer recoverHandler(conn, line)
+			panic("boom")
+		}()
+	}
+}
+
+func TestAddPromptReleasesLockOnPanic(t *testing.T) {
+	contextMutex.Lock()
+	contextMessagesPerChannel["#panic"] = []*ContextMessage{nil} // makes addPrompt panic
+	contextMutex.Unlock()
+	defer func() {
+		contextMutex.Lock()
+		delete(contextMessagesPerChannel, "#panic")
+		contextMutex.Unlock()
+	}()
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("addPrompt didn't panic")
+			}
+		}()
+		addPrompt(Config{}, "#panic", "alice", "hi")
+	}()
+	if !contextMutex.TryLock() {
+		t.Fatal("contextMutex is still locked after a panic in addPrompt")
+	}
+	contextMutex.Unlock()
+}
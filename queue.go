@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultPromptQueueSize = 5
+
+// a worker with nothing to do for this long exits, so queues for one-off private chats don't pile up
+const promptWorkerIdle = 10 * time.Minute
+
+// per-channel queues of pending prompts, each drained in order by its own worker goroutine
+var promptQueues = struct {
+	sync.Mutex
+	queues map[string]chan func()
+}{queues: make(map[string]chan func())}
+
+// enqueuePrompt queues a job for the channel's worker, starting the worker on first use.
+// It returns false if the channel's queue is full.
+func enqueuePrompt(config Config, channel string, job func()) bool {
+	promptQueues.Lock()
+	defer promptQueues.Unlock()
+	queue, ok := promptQueues.queues[channel]
+	if !ok {
+		size := config.PromptQueueSize
+		if size <= 0 {
+			size = defaultPromptQueueSize
+		}
+		queue = make(chan func(), size)
+		promptQueues.queues[channel] = queue
+		go promptWorker(channel, queue)
+	}
+
+	// sent under the lock, so an idle worker can't exit between looking up the queue and sending
+	select {
+	case queue <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// promptWorker runs the jobs of a channel's queue until it has been idle for promptWorkerIdle
+func promptWorker(channel string, queue chan func()) {
+	for {
+		select {
+		case job := <-queue:
+			runJob(channel, job)
+		case <-time.After(promptWorkerIdle):
+			promptQueues.Lock()
+			if len(queue) == 0 {
+				delete(promptQueues.queues, channel)
+				promptQueues.Unlock()
+				return
+			}
+			promptQueues.Unlock()
+		}
+	}
+}
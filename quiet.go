@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const quietTimeLayout = "15:04"
+
+// QuietHours is a daily window in which the bot only answers its owners. The window may
+// wrap around midnight, e.g. from 22:00 to 06:00.
+type QuietHours struct {
+	Start    string `json:"start"`    // "22:00"
+	End      string `json:"end"`      // "06:00"
+	Timezone string `json:"timezone"` // IANA name like "Europe/Berlin", default local time
+	Notice   bool   `json:"notice"`   // tell the channel once per window that the bot is quiet
+}
+
+// channels told about the current quiet window, by the date the window started
+var quietNotices = struct {
+	sync.Mutex
+	sent map[string]string
+}{sent: make(map[string]string)}
+
+// check reports a problem with the quiet hours, or nil
+func (q QuietHours) check() error {
+	start, err := time.Parse(quietTimeLayout, q.Start)
+	if err != nil {
+		return fmt.Errorf("start must be HH:MM")
+	}
+	end, err := time.Parse(quietTimeLayout, q.End)
+	if err != nil {
+		return fmt.Errorf("end must be HH:MM")
+	}
+	if start.Equal(end) {
+		return fmt.Errorf("start and end must differ")
+	}
+	if _, err := time.LoadLocation(q.Timezone); err != nil {
+		return fmt.Errorf("unknown timezone %s", q.Timezone)
+	}
+	return nil
+}
+
+// window reports whether now is within the quiet hours and, if so, the date the window started
+func (q QuietHours) window(now time.Time) (bool, string) {
+	location, err := time.LoadLocation(q.Timezone)
+	if err != nil {
+		return false, ""
+	}
+	start, errStart := time.Parse(quietTimeLayout, q.Start)
+	end, errEnd := time.Parse(quietTimeLayout, q.End)
+	if errStart != nil || errEnd != nil {
+		return false, ""
+	}
+	now = now.In(location)
+	minute := now.Hour()*60 + now.Minute()
+	from, until := start.Hour()*60+start.Minute(), end.Hour()*60+end.Minute()
+
+	today, yesterday := now.Format(time.DateOnly), now.AddDate(0, 0, -1).Format(time.DateOnly)
+	if from < until {
+		return minute >= from && minute < until, today
+	}
+	// the window wraps around midnight
+	if minute >= from {
+		return true, today
+	}
+	return minute < until, yesterday
+}
+
+// quietHoursFor returns the quiet hours of a channel: its own, the global ones, or nil
+func quietHoursFor(config Config, channel string) *QuietHours {
+	name := channelName(config, channel)
+	for configured, quiet := range config.ChannelQuietHours {
+		if normalizeChannel(configured) == name {
+			return &quiet
+		}
+	}
+	return config.QuietHours
+}
+
+// isQuiet reports whether the channel is in its quiet hours, and whether to send the
+// window's one-time notice. The notice is only used up if announce says it can be sent.
+func isQuiet(config Config, channel string, now time.Time, announce bool) (bool, bool) {
+	quiet := quietHoursFor(config, channel)
+	if quiet == nil {
+		return false, false
+	}
+	inside, started := quiet.window(now)
+	if !inside || !quiet.Notice || !announce {
+		return inside, false
+	}
+	quietNotices.Lock()
+	defer quietNotices.Unlock()
+	if quietNotices.sent[channel] == started {
+		return true, false
+	}
+	quietNotices.sent[channel] = started
+	return true, true
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	anthropic "github.com/liushuangls/go-anthropic/v2"
+)
+
+const backendAnthropic = "anthropic"
+const backendOpenAI = "openai"
+
+// Responder generates the assistant's reply to a conversation
+type Responder interface {
+	Generate(ctx context.Context, system string, messages []anthropic.Message) (string, error)
+}
+
+// generationInfo is implemented by responders that report the tokens used by their last
+// Generate call, a marker to show when a fallback model answered and whether the answer
+// was cut off by the token limit
+type generationInfo interface {
+	usage() anthropic.MessagesUsage
+	fallbackMarker() string
+	truncated() bool
+}
+
+// newResponder returns the responder for the configured backend. onText, if given, receives
+// streamed text from backends that support streaming.
+func newResponder(config Config, channel string, maxTokens int, onText func(string)) Responder {
+	if config.Backend == backendOpenAI {
+		return &openAIResponder{config: config, channel: channel, maxTokens: maxTokens}
+	}
+	return &anthropicResponder{config: config, channel: channel, maxTokens: maxTokens, onText: onText}
+}
+
+// anthropicResponder answers with the Anthropic Messages API, falling back to
+// FallbackModel when overloaded and running tools if enabled
+type anthropicResponder struct {
+	config    Config
+	channel   string
+	maxTokens int
+	onText    func(string)
+
+	used   anthropic.MessagesUsage
+	marker string
+	cut    bool
+}
+
+func (r *anthropicResponder) Generate(ctx context.Context, system string, messages []anthropic.Message) (string, error) {
+	config, channel := r.config, r.channel
+	request := anthropic.MessagesRequest{
+		Model:     modelFor(config, channel),
+		Messages:  messages,
+		MaxTokens: r.maxTokens,
+		System:    system,
+	}
+	if config.EnableTools {
+		request.Tools = toolDefinitions
+	}
+	request.Temperature, request.TopP = modelParams(config, channel)
+	// once streamed text was passed on it may already be on IRC, so it's too late to fall back
+	streamed := false
+	send := func(request anthropic.MessagesRequest) (anthropic.MessagesResponse, error) {
+		if r.onText != nil && len(request.Tools) == 0 {
+			return createMessagesStream(ctx, config, channel, request, func(text string) {
+				streamed = streamed || text != ""
+				r.onText(text)
+			})
+		}
+		return createMessages(ctx, config, channel, request)
+	}
+	resp, err := send(request)
+	if fallback, ok := resolveModel(config.FallbackModel); err != nil && ok && fallback != request.Model && isRateLimited(err) && !streamed {
+		log.Printf("Model %s unavailable (%v), retrying with %s\n", request.Model, err, fallback)
+		request.Model = fallback
+		r.marker = config.FallbackMarker
+		if r.onText != nil && r.marker != "" {
+			r.onText(r.marker + " ")
+		}
+		resp, err = send(request)
+	}
+	r.used = resp.Usage
+
+	// run requested tools and send their results back until the model gives a final answer
+	for round := 0; err == nil && resp.StopReason == anthropic.MessagesStopReasonToolUse && round < maxToolRounds; round++ {
+		request.Messages = append(request.Messages,
+			anthropic.Message{Role: anthropic.RoleAssistant, Content: resp.Content},
+			toolResults(resp.Content))
+		resp, err = createMessages(ctx, config, channel, request)
+		r.used.InputTokens += resp.Usage.InputTokens
+		r.used.OutputTokens += resp.Usage.OutputTokens
+	}
+	if err != nil {
+		return "", err
+	}
+	r.cut = resp.StopReason == anthropic.MessagesStopReasonMaxTokens
+	content := responseText(resp)
+	if content == "" {
+		log.Printf("Anthropic returned no text, stop reason: %s\n", resp.StopReason)
+	}
+	log.Printf("Anthropic response from %s: %s\n", request.Model, content)
+	return content, nil
+}
+
+func (r *anthropicResponder) usage() anthropic.MessagesUsage {
+	return r.used
+}
+
+func (r *anthropicResponder) fallbackMarker() string {
+	return r.marker
+}
+
+func (r *anthropicResponder) truncated() bool {
+	return r.cut
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+// how long to wait for goirc to take a line into its send queue, and once more before giving up
+const sendTimeout = 5 * time.Second
+const sendRetryDelay = 2 * time.Second
+
+var errNotConnected = errors.New("not connected")
+
+// capability needed to send client tags like +draft/reply
+const messageTagsCap = "message-tags"
+
+// escapes for IRCv3 tag values
+var tagValueEscaper = strings.NewReplacer("\\", "\\\\", ";", "\\:", " ", "\\s", "\r", "\\r", "\n", "\\n")
+
+// privmsg sends a PRIVMSG, tagged as a reply to the message with id replyTo if the server
+// negotiated message tags, so clients can thread it
+func privmsg(conn *irc.Conn, target, replyTo, text string) {
+	if replyTo == "" || !conn.HasCapability(messageTagsCap) {
+		conn.Privmsg(target, text)
+		return
+	}
+	conn.Raw("@+draft/reply=" + tagValueEscaper.Replace(replyTo) + " " + irc.PRIVMSG + " " + target + " :" + text)
+}
+
+// replyText sends a short reply to line through deliver, threaded like answers
+func replyText(conn *irc.Conn, line *irc.Line, text string) {
+	deliver(conn, replyTarget(line), line.Tags["msgid"], text)
+}
+
+// deliver sends a PRIVMSG without blocking on a dead connection. goirc's send queue blocks
+// when it is full and the writer has stopped, so the line is handed over in a goroutine.
+// If that stalls while connected, it waits once more before dropping the line; sending it
+// again would duplicate it, as the stalled line is still queued.
+func deliver(conn *irc.Conn, target, replyTo, text string) error {
+	if !conn.Connected() {
+		log.Printf("Not connected, dropping message to %s: %s\n", target, text)
+		return errNotConnected
+	}
+	queued := make(chan struct{})
+	go func() {
+		privmsg(conn, target, replyTo, text)
+		close(queued)
+	}()
+	select {
+	case <-queued:
+		return nil
+	case <-time.After(sendTimeout):
+	}
+
+	log.Printf("Sending to %s stalled, retrying in %s\n", target, sendRetryDelay)
+	select {
+	case <-queued:
+		return nil
+	case <-time.After(sendRetryDelay):
+	}
+	err := errors.New("send queue stalled")
+	if !conn.Connected() {
+		err = errNotConnected
+	}
+	log.Printf("Dropping message to %s: %v: %s\n", target, err, text)
+	return err
+}
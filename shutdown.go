@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+const shutdownTimeout = 5 * time.Second
+
+// clients of all networks, so a shutdown can QUIT each of them
+var ircClients = struct {
+	sync.Mutex
+	clients []*irc.Conn
+}{}
+
+// shutdownRequests receives the reason for a shutdown from !shutdown or a signal
+var shutdownRequests = make(chan string, 1)
+
+func registerClient(client *irc.Conn) {
+	ircClients.Lock()
+	defer ircClients.Unlock()
+	ircClients.clients = append(ircClients.clients, client)
+}
+
+// requestShutdown asks main to shut the bot down; repeated requests are ignored
+func requestShutdown(reason string) {
+	select {
+	case shutdownRequests <- reason:
+	default:
+	}
+}
+
+// notifyOnSignals requests a shutdown on SIGINT and SIGTERM
+func notifyOnSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		requestShutdown("received " + sig.String())
+	}()
+}
+
+// shutdown quits all connections, waits briefly for them to close and flushes the audit log
+func shutdown(reason string, disconnected <-chan struct{}) {
+	log.Printf("Shutting down: %s\n", reason)
+	ircClients.Lock()
+	for _, client := range ircClients.clients {
+		if client.Connected() {
+			client.Quit()
+		}
+	}
+	ircClients.Unlock()
+
+	select {
+	case <-disconnected:
+	case <-time.After(shutdownTimeout):
+		log.Printf("Timed out waiting for disconnect\n")
+	}
+
+	if auditLog != nil {
+		auditLog.Close()
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	anthropic "github.com/liushuangls/go-anthropic/v2"
+)
+
+// streamed text is flushed once this much of a sentence has accumulated
+const minStreamFlush = 80
+
+// lineStreamer collects streamed text and sends it as IRC lines at sentence boundaries
+type lineStreamer struct {
+	send     func(string)
+	buffer   string
+	lines    int
+	maxLines int
+	started  bool
+	prefix   string // added to the first line, see decorateReply
+	suffix   string // added to the last line
+
+	// the last line allowed by maxLines is held back until finish, so it can tell about dropped lines
+	held    string
+	dropped int
+}
+
+func newLineStreamer(maxLines int, send func(string)) *lineStreamer {
+	return &lineStreamer{send: send, maxLines: maxLines}
+}
+
+// write adds streamed text and sends every complete chunk
+func (s *lineStreamer) write(text string) {
+	s.buffer += text
+	for {
+		cut := flushPoint(s.buffer)
+		if cut <= 0 {
+			return
+		}
+		s.emit(s.buffer[:cut], false)
+		s.buffer = s.buffer[cut:]
+	}
+}
+
+// finish sends whatever is left in the buffer
+func (s *lineStreamer) finish() {
+	if sanitizeLine(s.buffer) == "" && s.started && s.suffix != "" && s.held == "" && s.lines < s.maxLines {
+		// the last line was already sent, so the suffix goes on its own line
+		s.send(s.suffix)
+	}
+	s.emit(s.buffer, true)
+	s.buffer = ""
+	if s.held != "" {
+		suffix := s.suffix
+		if s.dropped > 0 {
+			log.Printf("Dropped %d streamed lines beyond %d lines\n", s.dropped, s.maxLines)
+			suffix = strings.TrimSpace(fmt.Sprintf(omittedLinesMarker, s.dropped) + " " + suffix)
+		}
+		s.send(decorateLine("", s.held, suffix))
+		s.held = ""
+	}
+}
+
+func (s *lineStreamer) emit(text string, last bool) {
+	line := sanitizeLine(text)
+	if line == "" {
+		return
+	}
+	s.started = true
+	if s.held != "" {
+		s.dropped++
+		return
+	}
+	prefix, suffix := "", ""
+	if s.lines == 0 {
+		prefix = s.prefix
+	}
+	s.lines++
+	if !last && s.lines >= s.maxLines {
+		s.held = decorateLine(prefix, line, "")
+		return
+	}
+	if last {
+		suffix = s.suffix
+	}
+	s.send(decorateLine(prefix, line, suffix))
+}
+
+// flushPoint returns where to cut the buffer: after the last sentence end once enough text
+// has accumulated, where splitLine would break a line that got too long, or 0 to keep waiting
+func flushPoint(buffer string) int {
+	if len(buffer) >= maxIRCMessageLength {
+		return len(splitLine(buffer, maxIRCMessageLength)[0])
+	}
+	if len(buffer) < minStreamFlush {
+		return 0
+	}
+	end := -1
+	for _, terminator := range []string{". ", "! ", "? ", "。", "！", "？", "\n"} {
+		if i := strings.LastIndex(buffer, terminator); i > end {
+			end = i + len(terminator)
+		}
+	}
+	if end < minStreamFlush {
+		return 0
+	}
+	return end
+}
+
+// createMessagesStream streams a request to Anthropic, passing text deltas to onText
+func createMessagesStream(ctx context.Context, config Config, channel string, request anthropic.MessagesRequest, onText func(string)) (anthropic.MessagesResponse, error) {
+	start := time.Now()
+	resp, err := clientFor(config, channel).CreateMessagesStream(ctx, anthropic.MessagesStreamRequest{
+		MessagesRequest: request,
+		OnContentBlockDelta: func(data anthropic.MessagesEventContentBlockDeltaData) {
+			onText(data.Delta.GetText())
+		},
+	})
+	if config.LogUsage && err == nil {
+		log.Printf("Usage %s: model=%s input=%d output=%d latency=%s (streamed)\n", channel, request.Model,
+			resp.Usage.InputTokens, resp.Usage.OutputTokens, time.Since(start).Round(time.Millisecond))
+	}
+	return resp, err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	anthropic "github.com/liushuangls/go-anthropic/v2"
+)
+
+const summaryMaxTokens = 200
+const summaryPrompt = "Summarize the following IRC conversation between users and you (the assistant) in at most 400 characters." +
+	" Keep names, facts and open questions that may matter later. Reply with the summary only."
+
+// evicted turns collected before they are summarized, so a full context doesn't cost a summary per prompt
+const summaryBatchTurns = 5
+
+// channelSummary holds the summary of a channel's evicted context, the lowercased nicks whose
+// prompts went into it and the turns not summarized yet
+type channelSummary struct {
+	text    string
+	nicks   map[string]bool
+	backlog []*ContextMessage
+	running bool
+}
+
+// summaries of context evicted from each channel, guarded by contextMutex. !reset drops the
+// entry, so a summary still being generated for it is discarded.
+var contextSummaries = make(map[string]*channelSummary)
+
+// queueEvicted adds evicted turns to the channel's backlog and starts summarizing them once
+// enough have piled up, running at most one summary per channel at a time
+func queueEvicted(config Config, channel string, evicted []*ContextMessage) {
+	contextMutex.Lock()
+	defer contextMutex.Unlock()
+	summary, ok := contextSummaries[channel]
+	if !ok {
+		summary = &channelSummary{nicks: make(map[string]bool)}
+		contextSummaries[channel] = summary
+	}
+	summary.backlog = append(summary.backlog, evicted...)
+	if summary.running || len(summary.backlog) < summaryBatchTurns {
+		return
+	}
+	summary.running = true
+	go summarizeEvicted(config, channel, summary)
+}
+
+// summarizeEvicted folds the backlog of evicted turns into the summary until fewer than a batch are left
+func summarizeEvicted(config Config, channel string, summary *channelSummary) {
+	for {
+		contextMutex.Lock()
+		if len(summary.backlog) < summaryBatchTurns {
+			summary.running = false
+			contextMutex.Unlock()
+			return
+		}
+		var transcript strings.Builder
+		if summary.text != "" {
+			transcript.WriteString("Earlier summary: " + summary.text + "\n")
+		}
+		for _, msg := range summary.backlog {
+			summary.nicks[strings.ToLower(msg.Nick)] = true
+			transcript.WriteString(msg.Role + ": " + msg.Content + "\n")
+			if msg.Response != nil {
+				transcript.WriteString(msg.Response.Role + ": " + msg.Response.Content + "\n")
+			}
+		}
+		batch := len(summary.backlog)
+		summary.backlog = nil
+		contextMutex.Unlock()
+
+		text, err := generateSummary(config, channel, transcript.String())
+		if err != nil {
+			log.Printf("Error summarizing %d evicted turns of %s: %v\n", batch, channel, err)
+			continue
+		}
+		log.Printf("Context summary for %s: %s\n", channel, text)
+		contextMutex.Lock()
+		summary.text = text
+		contextMutex.Unlock()
+	}
+}
+
+// generateSummary asks the model to summarize the transcript. It runs in the background,
+// outside the recovered handlers, so a panic is recovered here and returned as an error.
+func generateSummary(config Config, channel, transcript string) (summary string, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			logPanic("summarizing "+channel, recovered)
+			summary, err = "", fmt.Errorf("panic: %v", recovered)
+		}
+	}()
+	if err := acquireRequestSlot(); err != nil {
+		return "", err
+	}
+	defer releaseRequestSlot()
+	responder := newResponder(config, channel, summaryMaxTokens, nil)
+	summary, err = responder.Generate(context.Background(), summaryPrompt,
+		[]anthropic.Message{anthropic.NewUserTextMessage(transcript)})
+	if info, ok := responder.(generationInfo); ok {
+		addTokenUsage(channel, info.usage().InputTokens+info.usage().OutputTokens)
+	}
+	return strings.TrimSpace(summary), err
+}
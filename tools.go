@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	anthropic "github.com/liushuangls/go-anthropic/v2"
+)
+
+// maximum number of tool round trips per prompt
+const maxToolRounds = 3
+
+// local tools offered to the model when EnableTools is set
+var toolDefinitions = []anthropic.ToolDefinition{
+	{
+		Name:        "current_time",
+		Description: "Returns the current date and time in UTC and in the given IANA time zone, if any.",
+		InputSchema: json.RawMessage(`{"type":"object","properties":{"timezone":{"type":"string","description":"IANA time zone, e.g. Europe/Berlin"}}}`),
+	},
+	{
+		Name:        "evaluate_math",
+		Description: "Evaluates an arithmetic expression with + - * / % ^ and parentheses and returns the result.",
+		InputSchema: json.RawMessage(`{"type":"object","properties":{"expression":{"type":"string","description":"e.g. (2+3)*4^2"}},"required":["expression"]}`),
+	},
+}
+
+// toolResults runs the tool calls in a response and returns the user message carrying their results
+func toolResults(content []anthropic.MessageContent) anthropic.Message {
+	results := anthropic.Message{Role: anthropic.RoleUser}
+	for _, block := range content {
+		if block.Type != anthropic.MessagesContentTypeToolUse || block.MessageContentToolUse == nil {
+			continue
+		}
+		input, _ := block.Input.(map[string]any)
+		result, err := runTool(block.Name, input)
+		if err != nil {
+			log.Printf("Tool %s failed: %v\n", block.Name, err)
+			results.Content = append(results.Content, anthropic.NewToolResultMessageContent(block.ID, err.Error(), true))
+			continue
+		}
+		log.Printf("Tool %s(%v) = %s\n", block.Name, input, result)
+		results.Content = append(results.Content, anthropic.NewToolResultMessageContent(block.ID, result, false))
+	}
+	return results
+}
+
+// runTool executes a single tool call
+func runTool(name string, input map[string]any) (string, error) {
+	switch name {
+	case "current_time":
+		now := time.Now()
+		result := now.UTC().Format(time.RFC1123)
+		if zone, _ := input["timezone"].(string); zone != "" {
+			location, err := time.LoadLocation(zone)
+			if err != nil {
+				return "", fmt.Errorf("unknown time zone %q", zone)
+			}
+			result += "; " + now.In(location).Format(time.RFC1123)
+		}
+		return result, nil
+	case "evaluate_math":
+		expression, _ := input["expression"].(string)
+		value, err := evaluateMath(expression)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatFloat(value, 'g', -1, 64), nil
+	default:
+		return "", fmt.Errorf("unknown tool %q", name)
+	}
+}
+
+// evaluateMath evaluates an arithmetic expression using a small recursive descent parser
+func evaluateMath(expression string) (float64, error) {
+	p := &mathParser{input: strings.ReplaceAll(expression, " ", "")}
+	value, err := p.sum()
+	if err != nil {
+		return 0, err
+	}
+	if p.pos < len(p.input) {
+		return 0, fmt.Errorf("unexpected %q at position %d", p.input[p.pos], p.pos)
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("result is not a finite number")
+	}
+	return value, nil
+}
+
+type mathParser struct {
+	input string
+	pos   int
+}
+
+func (p *mathParser) peek() byte {
+	if p.pos < len(p.input) {
+		return p.input[p.pos]
+	}
+	return 0
+}
+
+// sum = product { ("+" | "-") product }
+func (p *mathParser) sum() (float64, error) {
+	value, err := p.product()
+	for err == nil && (p.peek() == '+' || p.peek() == '-') {
+		op := p.peek()
+		p.pos++
+		var rhs float64
+		if rhs, err = p.product(); op == '+' {
+			value += rhs
+		} else {
+			value -= rhs
+		}
+	}
+	return value, err
+}
+
+// product = unary { ("*" | "/" | "%") unary }
+func (p *mathParser) product() (float64, error) {
+	value, err := p.unary()
+	for err == nil && (p.peek() == '*' || p.peek() == '/' || p.peek() == '%') {
+		op := p.peek()
+		p.pos++
+		var rhs float64
+		if rhs, err = p.unary(); err != nil {
+			break
+		}
+		switch op {
+		case '*':
+			value *= rhs
+		case '/':
+			value /= rhs
+		case '%':
+			value = math.Mod(value, rhs)
+		}
+	}
+	return value, err
+}
+
+// unary = ("-" | "+") unary | power
+func (p *mathParser) unary() (float64, error) {
+	if c := p.peek(); c == '-' || c == '+' {
+		p.pos++
+		value, err := p.unary()
+		if c == '-' {
+			value = -value
+		}
+		return value, err
+	}
+	return p.power()
+}
+
+// power = primary [ "^" unary ]
+func (p *mathParser) power() (float64, error) {
+	value, err := p.primary()
+	if err == nil && p.peek() == '^' {
+		p.pos++
+		var exponent float64
+		if exponent, err = p.unary(); err == nil {
+			value = math.Pow(value, exponent)
+		}
+	}
+	return value, err
+}
+
+// primary = "(" sum ")" | number
+func (p *mathParser) primary() (float64, error) {
+	if p.peek() == '(' {
+		p.pos++
+		value, err := p.sum()
+		if err != nil {
+			return 0, err
+		}
+		if p.peek() != ')' {
+			return 0, fmt.Errorf("missing closing parenthesis")
+		}
+		p.pos++
+		return value, nil
+	}
+	start := p.pos
+	for p.pos < len(p.input) && (unicode.IsDigit(rune(p.input[p.pos])) || p.input[p.pos] == '.') {
+		p.pos++
+	}
+	if start == p.pos {
+		if p.pos >= len(p.input) {
+			return 0, fmt.Errorf("unexpected end of expression")
+		}
+		return 0, fmt.Errorf("unexpected %q at position %d", p.input[p.pos], p.pos)
+	}
+	return strconv.ParseFloat(p.input[start:p.pos], 64)
+}